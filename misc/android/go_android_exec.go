@@ -11,10 +11,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -25,28 +31,10 @@ import (
 	"strings"
 	"sync"
 	"syscall"
-)
+	"time"
 
-func run(args ...string) (string, error) {
-	cmd := adbCmd(args...)
-	buf := new(strings.Builder)
-	cmd.Stdout = io.MultiWriter(os.Stdout, buf)
-	// If the adb subprocess somehow hangs, go test will kill this wrapper
-	// and wait for our os.Stderr (and os.Stdout) to close as a result.
-	// However, if the os.Stderr (or os.Stdout) file descriptors are
-	// passed on, the hanging adb subprocess will hold them open and
-	// go test will hang forever.
-	//
-	// Avoid that by wrapping stderr, breaking the short circuit and
-	// forcing cmd.Run to use another pipe and goroutine to pass
-	// along stderr from adb.
-	cmd.Stderr = struct{ io.Writer }{os.Stderr}
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("adb %s: %v", strings.Join(args, " "), err)
-	}
-	return buf.String(), nil
-}
+	"go_android_exec/protocol"
+)
 
 func adb(args ...string) error {
 	if out, err := adbCmd(args...).CombinedOutput(); err != nil {
@@ -57,15 +45,83 @@ func adb(args ...string) error {
 }
 
 func adbCmd(args ...string) *exec.Cmd {
+	var pre []string
 	if flags := os.Getenv("GOANDROID_ADB_FLAGS"); flags != "" {
-		args = append(strings.Split(flags, " "), args...)
+		pre = append(pre, strings.Split(flags, " ")...)
+	}
+	if deviceSerial != "" {
+		pre = append(pre, "-s", deviceSerial)
+	}
+	return exec.Command("adb", append(pre, args...)...)
+}
+
+// deviceSerial is the adb serial of the device this process was assigned by
+// acquireDevice, or "" before a device has been chosen (e.g. while listing
+// devices). It is set once per process and only ever read afterwards, so it
+// does not need synchronization.
+var deviceSerial string
+
+// devicePool returns the serials of the devices this wrapper is allowed to
+// schedule onto. GOANDROID_DEVICES, if set, is a comma-separated allowlist;
+// otherwise ANDROID_SERIAL restricts the pool to a single device, as it does
+// for adb itself. With neither set, every device or emulator adb knows about
+// is fair game.
+func devicePool() ([]string, error) {
+	if list := os.Getenv("GOANDROID_DEVICES"); list != "" {
+		return strings.Split(list, ","), nil
+	}
+	if serial := os.Getenv("ANDROID_SERIAL"); serial != "" {
+		return []string{serial}, nil
+	}
+	out, err := adbCmd("devices", "-l").Output()
+	if err != nil {
+		return nil, fmt.Errorf("adb devices -l: %w", err)
+	}
+	var serials []string
+	for _, line := range strings.Split(string(out), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "device" {
+			continue // skip the header, blank lines, and offline/unauthorized devices
+		}
+		serials = append(serials, fields[0])
+	}
+	if len(serials) == 0 {
+		return nil, errors.New("no connected android devices or emulators found (adb devices -l)")
+	}
+	return serials, nil
+}
+
+// acquireDevice picks a free device from the pool, sets deviceSerial to its
+// serial for the remainder of this process, and returns a lock file that
+// holds the device reserved until it is closed. It blocks if every device in
+// the pool is currently in use by another go_android_exec process.
+func acquireDevice() (*os.File, error) {
+	serials, err := devicePool()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		for _, serial := range serials {
+			lockPath := filepath.Join(os.TempDir(), "go_android_exec-"+serial+".lock")
+			lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0666)
+			if err != nil {
+				return nil, err
+			}
+			if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+				lock.Close()
+				continue // another process holds this device; try the next one
+			}
+			deviceSerial = serial
+			return lock, nil
+		}
+		time.Sleep(time.Second)
 	}
-	return exec.Command("adb", args...)
 }
 
 const (
-	deviceRoot   = "/data/local/tmp/go_android_exec"
-	deviceGoroot = deviceRoot + "/goroot"
+	deviceRoot         = "/data/local/tmp/go_android_exec"
+	deviceGoroot       = deviceRoot + "/goroot"
+	deviceManifestPath = deviceRoot + "/manifest.json"
 )
 
 func main() {
@@ -79,18 +135,16 @@ func main() {
 }
 
 func runMain() (int, error) {
-	// Concurrent use of adb is flaky, so serialize adb commands.
-	// See https://github.com/golang/go/issues/23795 or
-	// https://issuetracker.google.com/issues/73230216.
-	lockPath := filepath.Join(os.TempDir(), "go_android_exec-adb-lock")
-	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0666)
+	// Concurrent use of adb against the same device is flaky, so serialize
+	// adb commands per device. See https://github.com/golang/go/issues/23795
+	// or https://issuetracker.google.com/issues/73230216. Devices in the
+	// pool are otherwise independent, so this lets the go tool parallelize
+	// android tests across every attached device.
+	lock, err := acquireDevice()
 	if err != nil {
 		return 0, err
 	}
 	defer lock.Close()
-	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
-		return 0, err
-	}
 
 	// In case we're booting a device or emulator alongside all.bash, wait for
 	// it to be ready. adb wait-for-device is not enough, we have to
@@ -108,7 +162,7 @@ func runMain() (int, error) {
 	// Binary names can conflict.
 	// E.g. template.test from the {html,text}/template packages.
 	binName := filepath.Base(os.Args[1])
-	deviceGotmp := fmt.Sprintf(deviceRoot+"/%s-%d", binName, os.Getpid())
+	deviceGotmp := fmt.Sprintf(deviceRoot+"/%s-%s-%d", deviceSerial, binName, os.Getpid())
 	deviceGopath := deviceGotmp + "/gopath"
 	defer adb("exec-out", "rm", "-rf", deviceGotmp) // Clean up.
 
@@ -150,27 +204,91 @@ func runMain() (int, error) {
 	}
 
 	deviceBin := fmt.Sprintf("%s/%s", deviceGotmp, binName)
-	if err := adb("push", os.Args[1], deviceBin); err != nil {
-		return 0, err
-	}
 
 	// Forward SIGQUIT from the go command to show backtraces from
 	// the binary instead of from this wrapper.
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGQUIT)
-	go func() {
-		for range quit {
-			// We don't have the PID of the running process; use the
-			// binary name instead.
-			adb("exec-out", "killall -QUIT "+binName)
-		}
-	}()
-	// In light of
-	// https://code.google.com/p/android/issues/detail?id=3254
-	// dont trust the exitcode of adb. Instead, append the exitcode to
-	// the output and parse it from there.
-	const exitstr = "exitcode="
-	cmd := `export TMPDIR="` + deviceGotmp + `"` +
+	defer signal.Reset(syscall.SIGQUIT)
+	defer close(quit)
+
+	if helper, herr := acquirePersistentHelper(); herr == nil {
+		go func() {
+			for range quit {
+				// We don't have the PID of the running process; use the
+				// binary name instead.
+				if c, err := connectHelper(); err == nil {
+					kill, _ := protocol.Encode(protocol.Kill, protocol.KillPayload{Name: binName})
+					protocol.WriteFrame(c, kill)
+					c.Close()
+				}
+			}
+		}()
+		code, err := runPersistent(helper, os.Args[1], deviceBin, deviceGotmp, deviceGopath, deviceCwd, os.Args[2:])
+		if err == nil {
+			return code, nil
+		}
+		var started *errRunStarted
+		if errors.As(err, &started) {
+			// The binary may already have run (and partial output may
+			// already be on os.Stdout/Stderr); falling back now would
+			// re-execute it from scratch and double or corrupt the
+			// output, so surface the error instead.
+			return 0, fmt.Errorf("persistent helper: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "go_android_exec: persistent helper failed, falling back: %v\n", err)
+	} else {
+		go func() {
+			for range quit {
+				adb("exec-out", "killall -QUIT "+binName)
+			}
+		}()
+	}
+
+	if err := adb("push", os.Args[1], deviceBin); err != nil {
+		return 0, err
+	}
+
+	return runStreamed(deviceBin, deviceGotmp, deviceGopath, deviceCwd, os.Args[2:])
+}
+
+// runStreamed runs deviceBin on the device, forwarding its stdout and
+// stderr live and returning its exit code once it completes.
+//
+// adb exec-out merges stdout and stderr into one stream, and its own exit
+// code can't be trusted, which used to force this wrapper to run the binary
+// through a single 'adb exec-out' with the exit code appended to the merged
+// output and parsed out afterwards (see https://code.google.com/p/android/issues/detail?id=3254).
+// That lost the stdout/stderr distinction and buffered everything until the
+// process exited. Instead, redirect each stream to its own named pipe and
+// let two concurrent 'exec-out cat' pipelines drain them as they're
+// written, and read the exit code from a small file the binary's shell
+// wrapper writes once it's done.
+func runStreamed(deviceBin, deviceGotmp, deviceGopath, deviceCwd string, argv []string) (int, error) {
+	stdoutFifo := path.Join(deviceGotmp, "stdout.fifo")
+	stderrFifo := path.Join(deviceGotmp, "stderr.fifo")
+	exitFile := path.Join(deviceGotmp, "exitcode")
+	if err := adb("exec-out", "mkfifo", stdoutFifo, stderrFifo); err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, s := range []struct {
+		fifo string
+		w    io.Writer
+	}{
+		{stdoutFifo, os.Stdout},
+		{stderrFifo, os.Stderr},
+	} {
+		wg.Add(1)
+		go func(fifo string, w io.Writer) {
+			defer wg.Done()
+			errs <- streamFifo(fifo, w)
+		}(s.fifo, s.w)
+	}
+
+	script := `export TMPDIR="` + deviceGotmp + `"` +
 		`; export GOROOT="` + deviceGoroot + `"` +
 		`; export GOPATH="` + deviceGopath + `"` +
 		`; export CGO_ENABLED=0` +
@@ -178,26 +296,53 @@ func runMain() (int, error) {
 		`; export GOCACHE="` + deviceRoot + `/gocache"` +
 		`; export PATH="` + deviceGoroot + `/bin":$PATH` +
 		`; cd "` + deviceCwd + `"` +
-		"; '" + deviceBin + "' " + strings.Join(os.Args[2:], " ") +
-		"; echo -n " + exitstr + "$?"
-	output, err := run("exec-out", cmd)
-	signal.Reset(syscall.SIGQUIT)
-	close(quit)
-	if err != nil {
+		"; '" + deviceBin + "' " + strings.Join(argv, " ") +
+		` >"` + stdoutFifo + `" 2>"` + stderrFifo + `"` +
+		`; echo $? >"` + exitFile + `"`
+	if err := adb("exec-out", "sh", "-c", script+" </dev/null >/dev/null 2>&1 &"); err != nil {
 		return 0, err
 	}
 
-	exitIdx := strings.LastIndex(output, exitstr)
-	if exitIdx == -1 {
-		return 0, fmt.Errorf("no exit code: %q", output)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	out, err := adbOutput("exec-out", "cat", exitFile)
+	if err != nil {
+		return 0, fmt.Errorf("no exit code: %w", err)
 	}
-	code, err := strconv.Atoi(output[exitIdx+len(exitstr):])
+	code, err := strconv.Atoi(strings.TrimSpace(out))
 	if err != nil {
-		return 0, fmt.Errorf("bad exit code: %v", err)
+		return 0, fmt.Errorf("bad exit code: %q: %w", out, err)
 	}
 	return code, nil
 }
 
+// streamFifo copies devicePath's contents to w as they're written, blocking
+// until the writer on the device closes it.
+func streamFifo(devicePath string, w io.Writer) error {
+	cmd := adbCmd("exec-out", "cat", devicePath)
+	cmd.Stdout = w
+	// If this adb subprocess somehow hangs, go test will kill this wrapper
+	// and wait for our os.Stderr (and os.Stdout) to close as a result.
+	// However, if the os.Stderr (or os.Stdout) file descriptors are
+	// passed on, the hanging adb subprocess will hold them open and
+	// go test will hang forever.
+	//
+	// Avoid that by wrapping stderr, breaking the short circuit and
+	// forcing cmd.Run to use another pipe and goroutine to pass
+	// along stderr from adb.
+	cmd.Stderr = struct{ io.Writer }{os.Stderr}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("adb exec-out cat %s: %w", devicePath, err)
+	}
+	return nil
+}
+
 // pkgPath determines the package import path of the current working directory,
 // and indicates whether it is
 // and returns the path to the package source relative to $GOROOT (or $GOPATH).
@@ -266,6 +411,10 @@ func adbCopyTree(deviceCwd, subdir string) error {
 // including the go tool built for android.
 // A lock file ensures this only happens once, even with concurrent exec
 // wrappers.
+//
+// If GOANDROID_INCREMENTAL_SYNC=1 is set, deviceRoot is left alone and
+// adbSyncGorootIncremental is used instead, pushing only the files that
+// changed since the last sync.
 func adbCopyGoroot() error {
 	goTool, err := goTool()
 	if err != nil {
@@ -279,8 +428,10 @@ func adbCopyGoroot() error {
 	}
 	goVersion := string(out)
 
-	// Also known by cmd/dist. The bootstrap command deletes the file.
-	statPath := filepath.Join(os.TempDir(), "go_android_exec-adb-sync-status")
+	// Also known by cmd/dist, which deletes matching files as part of the
+	// bootstrap command. Keyed per-device, since each device in the pool
+	// tracks its own last-synced GOROOT version independently.
+	statPath := filepath.Join(os.TempDir(), "go_android_exec-adb-sync-status-"+deviceSerial)
 	stat, err := os.OpenFile(statPath, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return err
@@ -303,12 +454,6 @@ func adbCopyGoroot() error {
 		return err
 	}
 
-	// Delete the device's GOROOT, GOPATH and any leftover test data,
-	// and recreate GOROOT.
-	if err := adb("exec-out", "rm", "-rf", deviceRoot); err != nil {
-		return err
-	}
-
 	// Build Go for Android.
 	cmd = exec.Command(goTool, "install", "cmd")
 	out, err = cmd.CombinedOutput()
@@ -318,11 +463,7 @@ func adbCopyGoroot() error {
 		}
 		return fmt.Errorf("%v: %w", cmd, err)
 	}
-	if err := adb("exec-out", "mkdir", "-p", deviceGoroot); err != nil {
-		return err
-	}
 
-	// Copy the Android tools from the relevant bin subdirectory to GOROOT/bin.
 	cmd = exec.Command(goTool, "list", "-f", "{{.Target}}", "cmd/go")
 	cmd.Stderr = os.Stderr
 	out, err = cmd.Output()
@@ -333,18 +474,6 @@ func adbCopyGoroot() error {
 	if platformBin == "." {
 		return errors.New("failed to locate cmd/go for target platform")
 	}
-	if err := adb("push", platformBin, path.Join(deviceGoroot, "bin")); err != nil {
-		return err
-	}
-
-	// Copy only the relevant subdirectories from pkg: pkg/include and the
-	// platform-native binaries in pkg/tool.
-	if err := adb("exec-out", "mkdir", "-p", path.Join(deviceGoroot, "pkg", "tool")); err != nil {
-		return err
-	}
-	if err := adb("push", filepath.Join(goroot, "pkg", "include"), path.Join(deviceGoroot, "pkg", "include")); err != nil {
-		return err
-	}
 
 	cmd = exec.Command(goTool, "list", "-f", "{{.Target}}", "cmd/compile")
 	cmd.Stderr = os.Stderr
@@ -356,10 +485,41 @@ func adbCopyGoroot() error {
 	if platformToolDir == "." {
 		return errors.New("failed to locate cmd/compile for target platform")
 	}
-	relToolDir, err := filepath.Rel(filepath.Join(goroot), platformToolDir)
+	relToolDir, err := filepath.Rel(goroot, platformToolDir)
 	if err != nil {
 		return err
 	}
+
+	if os.Getenv("GOANDROID_INCREMENTAL_SYNC") == "1" {
+		if err := adbSyncGorootIncremental(goroot, platformBin, platformToolDir, relToolDir); err != nil {
+			return err
+		}
+		_, err = stat.WriteString(goVersion)
+		return err
+	}
+
+	// Delete the device's GOROOT, GOPATH and any leftover test data,
+	// and recreate GOROOT.
+	if err := adb("exec-out", "rm", "-rf", deviceRoot); err != nil {
+		return err
+	}
+	if err := adb("exec-out", "mkdir", "-p", deviceGoroot); err != nil {
+		return err
+	}
+
+	// Copy the Android tools from the relevant bin subdirectory to GOROOT/bin.
+	if err := adb("push", platformBin, path.Join(deviceGoroot, "bin")); err != nil {
+		return err
+	}
+
+	// Copy only the relevant subdirectories from pkg: pkg/include and the
+	// platform-native binaries in pkg/tool.
+	if err := adb("exec-out", "mkdir", "-p", path.Join(deviceGoroot, "pkg", "tool")); err != nil {
+		return err
+	}
+	if err := adb("push", filepath.Join(goroot, "pkg", "include"), path.Join(deviceGoroot, "pkg", "include")); err != nil {
+		return err
+	}
 	if err := adb("push", platformToolDir, path.Join(deviceGoroot, relToolDir)); err != nil {
 		return err
 	}
@@ -386,6 +546,423 @@ func adbCopyGoroot() error {
 	return nil
 }
 
+// manifestEntry describes the state of a single file relative to deviceGoroot.
+type manifestEntry struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// source pairs a host directory with the device path it syncs to.
+type source struct{ local, device string }
+
+// adbSyncGorootIncremental updates the device's GOROOT in place, pushing only
+// files that changed since the last sync instead of wiping and re-pushing
+// everything. It is enabled by GOANDROID_INCREMENTAL_SYNC=1.
+func adbSyncGorootIncremental(goroot, platformBin, platformToolDir, relToolDir string) error {
+	sources := []source{
+		{platformBin, path.Join(deviceGoroot, "bin")},
+		{platformToolDir, path.Join(deviceGoroot, relToolDir)},
+		{filepath.Join(goroot, "pkg", "include"), path.Join(deviceGoroot, "pkg", "include")},
+	}
+	for _, name := range []string{"src", "lib", "misc"} {
+		dir := filepath.Join(goroot, name)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			sources = append(sources, source{dir, path.Join(deviceGoroot, name)})
+		}
+	}
+
+	local, localPaths, err := computeLocalManifest(sources)
+	if err != nil {
+		return err
+	}
+	remote, err := fetchDeviceManifest()
+	if err != nil {
+		return err
+	}
+
+	if err := adb("exec-out", "mkdir", "-p", deviceGoroot); err != nil {
+		return err
+	}
+
+	dirsCreated := map[string]bool{deviceGoroot: true}
+	for key, entry := range local {
+		if old, ok := remote[key]; ok && old == entry {
+			continue
+		}
+		devicePath := path.Join(deviceGoroot, key)
+		if dir := path.Dir(devicePath); !dirsCreated[dir] {
+			if err := adb("exec-out", "mkdir", "-p", dir); err != nil {
+				return err
+			}
+			dirsCreated[dir] = true
+		}
+		if err := adb("push", localPaths[key], devicePath); err != nil {
+			return err
+		}
+	}
+
+	for key := range remote {
+		if _, ok := local[key]; !ok {
+			if err := adb("exec-out", "rm", "-f", path.Join(deviceGoroot, key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	manifestJSON, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+	return adbWriteFile(manifestJSON, deviceManifestPath)
+}
+
+// computeLocalManifest walks each source directory and hashes its files in
+// parallel, keyed by the path each file will occupy relative to deviceGoroot.
+// It also returns the on-host path for each key, so changed files can be
+// pushed without walking the tree a second time.
+func computeLocalManifest(sources []source) (manifest map[string]manifestEntry, localPaths map[string]string, err error) {
+	type job struct{ path, key string }
+	var jobs []job
+	for _, src := range sources {
+		err := filepath.WalkDir(src.local, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(src.local, p)
+			if err != nil {
+				return err
+			}
+			// devicePath is always under deviceGoroot by construction (see
+			// the sources built in adbSyncGorootIncremental), so a plain
+			// prefix trim gives the manifest key. Device paths are always
+			// forward-slash, so this must stay path-only: filepath.Rel would
+			// apply OS path semantics (e.g. Windows volume handling) to
+			// strings that are never actually host paths.
+			devicePath := path.Join(src.device, filepath.ToSlash(rel))
+			key := strings.TrimPrefix(devicePath, deviceGoroot+"/")
+			jobs = append(jobs, job{path: p, key: key})
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	hashes := make([]string, len(jobs))
+	sizes := make([]int64, len(jobs))
+	errs := make([]error, len(jobs))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, p string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			hashes[i], sizes[i], errs[i] = hashFile(p)
+		}(i, j.path)
+	}
+	wg.Wait()
+
+	manifest = make(map[string]manifestEntry, len(jobs))
+	localPaths = make(map[string]string, len(jobs))
+	for i, j := range jobs {
+		if errs[i] != nil {
+			return nil, nil, errs[i]
+		}
+		manifest[j.key] = manifestEntry{Size: sizes[i], SHA256: hashes[i]}
+		localPaths[j.key] = j.path
+	}
+	return manifest, localPaths, nil
+}
+
+func hashFile(p string) (sum string, size int64, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// fetchDeviceManifest returns the manifest describing deviceGoroot as it
+// currently exists on the device. It prefers the manifest cached from the
+// previous sync (a single "cat"), and falls back to hashing the tree with a
+// single "find | sha256sum" round trip if no usable cache exists.
+func fetchDeviceManifest() (map[string]manifestEntry, error) {
+	if out, err := adbOutput("exec-out", "cat", deviceManifestPath); err == nil {
+		var entries map[string]manifestEntry
+		if err := json.Unmarshal([]byte(out), &entries); err == nil {
+			return entries, nil
+		}
+	}
+	return adbHashDeviceGoroot()
+}
+
+func adbHashDeviceGoroot() (map[string]manifestEntry, error) {
+	const script = `cd "` + deviceGoroot + `" 2>/dev/null || exit 0
+find bin pkg/tool pkg/include src lib misc -type f 2>/dev/null | while read -r f; do
+  sum=$(sha256sum "$f") || continue
+  size=$(wc -c <"$f") || continue
+  printf '%s %s %s\n' "$size" "${sum%% *}" "$f"
+done`
+	out, err := adbOutput("exec-out", "sh", "-c", script)
+	if err != nil {
+		return map[string]manifestEntry{}, nil
+	}
+	entries := make(map[string]manifestEntry)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries[fields[2]] = manifestEntry{Size: size, SHA256: fields[1]}
+	}
+	return entries, nil
+}
+
+// adbOutput runs adb and returns its stdout, unlike adb which discards it.
+func adbOutput(args ...string) (string, error) {
+	out, err := adbCmd(args...).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return "", fmt.Errorf("adb %s: %w: %s", strings.Join(args, " "), err, ee.Stderr)
+		}
+		return "", fmt.Errorf("adb %s: %w", strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+// adbWriteFile writes data to devicePath without a temporary file on the
+// host side, by piping it directly into the adb subprocess's stdin.
+func adbWriteFile(data []byte, devicePath string) error {
+	cmd := adbCmd("exec-out", "sh", "-c", `cat > "`+devicePath+`"`)
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "adb exec-out cat > %s\n%s", devicePath, out)
+		return err
+	}
+	return nil
+}
+
+// daemonDevicePort is the loopback TCP port goexecd listens on, on-device.
+// Every device's goexecd binds the same port in its own network namespace,
+// so this one is safe to share.
+const daemonDevicePort = "7394"
+
+const daemonDeviceBin = deviceRoot + "/goexecd"
+
+// daemonHostPort returns the host-side port "adb forward" should map to
+// daemonDevicePort for the current device. chunk0-2 lets several
+// go_android_exec processes run concurrently against different devices in
+// the pool, and adb forward is host-wide, so a single shared host port would
+// have every process but the first either fail to forward or silently steal
+// the forward out from under another device. Hashing the serial gives each
+// device a host port of its own without requiring any cross-process
+// coordination.
+func daemonHostPort() string {
+	h := fnv.New32a()
+	h.Write([]byte(deviceSerial))
+	const base, span = 20000, 40000
+	return strconv.Itoa(base + int(h.Sum32()%span))
+}
+
+// connectHelper dials a running goexecd and performs the version handshake.
+func connectHelper() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+daemonHostPort(), 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	hs, _ := protocol.Encode(protocol.Handshake, protocol.HandshakePayload{Version: protocol.Version})
+	if err := protocol.WriteFrame(conn, hs); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := protocol.ReadFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if f.Type != protocol.Ack {
+		conn.Close()
+		return nil, fmt.Errorf("handshake rejected: %s", f.Type)
+	}
+	return conn, nil
+}
+
+// acquirePersistentHelper returns a connection to a running goexecd,
+// building, pushing and spawning one first if none is reachable yet. It
+// reports an error (rather than panicking or logging fatally) whenever the
+// persistent path isn't available, so callers can fall back to the
+// non-persistent exec-out path used before goexecd existed.
+func acquirePersistentHelper() (net.Conn, error) {
+	if os.Getenv("GOANDROID_PERSISTENT") == "0" {
+		return nil, errors.New("disabled by GOANDROID_PERSISTENT=0")
+	}
+	if conn, err := connectHelper(); err == nil {
+		return conn, nil
+	}
+
+	goroot, err := findGoroot()
+	if err != nil {
+		return nil, err
+	}
+	goTool, err := goTool()
+	if err != nil {
+		return nil, err
+	}
+	tmpBin, err := os.CreateTemp("", "goexecd-*")
+	if err != nil {
+		return nil, err
+	}
+	tmpBin.Close()
+	defer os.Remove(tmpBin.Name())
+
+	src := filepath.Join(goroot, "misc", "android", "goexecd", "main.go")
+	cmd := exec.Command(goTool, "build", "-o", tmpBin.Name(), src)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("building goexecd: %w", err)
+	}
+	if err := adb("push", tmpBin.Name(), daemonDeviceBin); err != nil {
+		return nil, err
+	}
+	if err := adb("exec-out", "chmod", "+x", daemonDeviceBin); err != nil {
+		return nil, err
+	}
+	if err := adb("forward", "tcp:"+daemonHostPort(), "tcp:"+daemonDevicePort); err != nil {
+		return nil, err
+	}
+	if err := adb("shell", daemonDeviceBin+" "+daemonDevicePort+" </dev/null >/dev/null 2>&1 &"); err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for i := 0; i < 20; i++ {
+		if conn, err := connectHelper(); err == nil {
+			return conn, nil
+		} else {
+			lastErr = err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("goexecd did not come up: %w", lastErr)
+}
+
+// errRunStarted wraps an error from runPersistent that happened after the
+// Run request was sent to goexecd, meaning the test binary may already be
+// executing (or partial output may already have reached os.Stdout/Stderr).
+// runMain must not treat such an error as "the helper is unavailable" and
+// fall back to re-running the same binary over the non-persistent path.
+type errRunStarted struct{ err error }
+
+func (e *errRunStarted) Error() string { return e.err.Error() }
+func (e *errRunStarted) Unwrap() error { return e.err }
+
+// runPersistent pushes localBin to the device and runs it through an
+// already-handshaken goexecd connection, forwarding its stdout/stderr live
+// and returning its exit code. conn is closed before returning. Once the Run
+// request has been sent, any error is wrapped in *errRunStarted, since the
+// caller can no longer safely retry on the non-persistent path.
+func runPersistent(conn net.Conn, localBin, deviceBin, deviceGotmp, deviceGopath, deviceCwd string, argv []string) (int, error) {
+	defer conn.Close()
+
+	f, err := os.Open(localBin)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	push, _ := protocol.Encode(protocol.PushBinary, protocol.PushBinaryPayload{Path: deviceBin, Size: fi.Size()})
+	if err := protocol.WriteFrame(conn, push); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(conn, f); err != nil {
+		return 0, err
+	}
+	ack, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return 0, err
+	}
+	if ack.Type != protocol.Ack {
+		return 0, helperError(ack)
+	}
+
+	env := []string{
+		"TMPDIR=" + deviceGotmp,
+		"GOROOT=" + deviceGoroot,
+		"GOPATH=" + deviceGopath,
+		"CGO_ENABLED=0",
+		"GOPROXY=" + os.Getenv("GOPROXY"),
+		"GOCACHE=" + deviceRoot + "/gocache",
+		"PATH=" + deviceGoroot + "/bin:/system/bin",
+	}
+	run, _ := protocol.Encode(protocol.Run, protocol.RunPayload{
+		Cwd:  deviceCwd,
+		Env:  env,
+		Argv: append([]string{deviceBin}, argv...),
+	})
+	if err := protocol.WriteFrame(conn, run); err != nil {
+		// Unlike the push above, we can't tell whether goexecd received
+		// enough of this frame to start the binary, so treat it as started.
+		return 0, &errRunStarted{err}
+	}
+
+	for {
+		f, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return 0, &errRunStarted{err}
+		}
+		switch f.Type {
+		case protocol.Output:
+			var out protocol.OutputPayload
+			if err := protocol.Decode(f, &out); err != nil {
+				return 0, &errRunStarted{err}
+			}
+			if out.Stream == "stderr" {
+				os.Stderr.Write(out.Data)
+			} else {
+				os.Stdout.Write(out.Data)
+			}
+		case protocol.Exit:
+			var e protocol.ExitPayload
+			if err := protocol.Decode(f, &e); err != nil {
+				return 0, &errRunStarted{err}
+			}
+			return e.Code, nil
+		case protocol.Error:
+			return 0, &errRunStarted{helperError(f)}
+		default:
+			return 0, &errRunStarted{fmt.Errorf("unexpected frame from goexecd: %s", f.Type)}
+		}
+	}
+}
+
+func helperError(f protocol.Frame) error {
+	var e protocol.ErrorPayload
+	protocol.Decode(f, &e)
+	return fmt.Errorf("goexecd: %s", e.Message)
+}
+
 func findGoroot() (string, error) {
 	gorootOnce.Do(func() {
 		// If runtime.GOROOT reports a non-empty path, assume that it is valid.
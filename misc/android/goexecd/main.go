@@ -0,0 +1,194 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+// +build ignore
+
+// goexecd is the optional persistent counterpart to go_android_exec. It is
+// built for the target GOOS/GOARCH, pushed to the device once, and spawned
+// in the background, where it listens on a loopback TCP port for framed
+// commands (see the protocol package) instead of making go_android_exec
+// pay for a fresh "adb exec-out" process per test binary.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+
+	"go_android_exec/protocol"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("goexecd: ")
+
+	port := "7394"
+	if len(os.Args) > 1 {
+		port = os.Args[1]
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ln.Close()
+
+	serve(ln)
+}
+
+// serve accepts connections on ln and handles each on its own goroutine
+// until Accept fails (e.g. ln is closed). Split out from main so tests can
+// drive a real listener without going through os.Args/log.Fatal.
+func serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handleConn(conn)
+	}
+}
+
+// handleConn serves a connection for as long as the client keeps it open: a
+// client dials, performs the handshake, then sends any number of command
+// frames in sequence (e.g. a PushBinary followed by the Run it prepared),
+// reading each response before sending the next. The connection ends when
+// the client closes it or a frame can't be read.
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	f, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return
+	}
+	if f.Type != protocol.Handshake {
+		writeError(conn, fmt.Sprintf("expected handshake, got %s", f.Type))
+		return
+	}
+	var hs protocol.HandshakePayload
+	if err := protocol.Decode(f, &hs); err != nil || hs.Version != protocol.Version {
+		writeError(conn, fmt.Sprintf("unsupported protocol version %d", hs.Version))
+		return
+	}
+	ack, _ := protocol.Encode(protocol.Ack, nil)
+	if err := protocol.WriteFrame(conn, ack); err != nil {
+		return
+	}
+
+	for {
+		f, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		switch f.Type {
+		case protocol.PushBinary:
+			handlePushBinary(conn, f)
+		case protocol.Run:
+			handleRun(conn, f)
+		case protocol.Kill:
+			handleKill(conn, f)
+		default:
+			writeError(conn, fmt.Sprintf("unexpected frame type %s", f.Type))
+		}
+	}
+}
+
+func handlePushBinary(conn net.Conn, f protocol.Frame) {
+	var req protocol.PushBinaryPayload
+	if err := protocol.Decode(f, &req); err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+	out, err := os.OpenFile(req.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+	defer out.Close()
+	if _, err := io.CopyN(out, conn, req.Size); err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+	ack, _ := protocol.Encode(protocol.Ack, nil)
+	protocol.WriteFrame(conn, ack)
+}
+
+func handleRun(conn net.Conn, f protocol.Frame) {
+	var req protocol.RunPayload
+	if err := protocol.Decode(f, &req); err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+
+	cmd := exec.Command(req.Argv[0], req.Argv[1:]...)
+	cmd.Dir = req.Cwd
+	cmd.Env = req.Env
+	// os/exec reads cmd.Stdout and cmd.Stderr on separate goroutines when
+	// they're distinct values, so the two frameWriters below share a mutex:
+	// WriteFrame is two Writes (length prefix, then payload), and without
+	// serializing them a concurrent stdout/stderr write can interleave their
+	// frames on conn and corrupt the stream for ReadFrame on the other end.
+	var mu sync.Mutex
+	cmd.Stdout = &frameWriter{conn: conn, stream: "stdout", mu: &mu}
+	cmd.Stderr = &frameWriter{conn: conn, stream: "stderr", mu: &mu}
+
+	err := cmd.Run()
+	code := 0
+	if ee, ok := err.(*exec.ExitError); ok {
+		code = ee.ExitCode()
+	} else if err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+	exit, _ := protocol.Encode(protocol.Exit, protocol.ExitPayload{Code: code})
+	protocol.WriteFrame(conn, exit)
+}
+
+func handleKill(conn net.Conn, f protocol.Frame) {
+	var req protocol.KillPayload
+	if err := protocol.Decode(f, &req); err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+	// Best effort, mirroring the SIGQUIT-on-backtrace behavior of the
+	// non-persistent path: there's no PID to target directly, so signal by
+	// binary name instead.
+	exec.Command("killall", "-QUIT", req.Name).Run()
+	ack, _ := protocol.Encode(protocol.Ack, nil)
+	protocol.WriteFrame(conn, ack)
+}
+
+func writeError(conn net.Conn, msg string) {
+	f, _ := protocol.Encode(protocol.Error, protocol.ErrorPayload{Message: msg})
+	protocol.WriteFrame(conn, f)
+}
+
+// frameWriter streams writes to conn as Output frames as they arrive, so the
+// client can forward stdout/stderr live instead of waiting for the process
+// to exit. mu must be shared with the other stream's frameWriter for the
+// same Run, since os/exec writes stdout and stderr from separate goroutines
+// and WriteFrame is not itself safe for concurrent use on one conn.
+type frameWriter struct {
+	conn   net.Conn
+	stream string
+	mu     *sync.Mutex
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	f, err := protocol.Encode(protocol.Output, protocol.OutputPayload{Stream: w.stream, Data: bytes.Clone(p)})
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := protocol.WriteFrame(w.conn, f); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+// +build ignore
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go_android_exec/protocol"
+)
+
+// TestPushThenRunOnSameConnection drives handleConn through the exact
+// sequence runPersistent uses: handshake, then a PushBinary (with its
+// inline payload) followed by a Run, both on the one handshaken
+// connection. It would have caught handleConn returning after its first
+// command instead of serving the connection until the client is done
+// with it.
+func TestPushThenRunOnSameConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	go serve(ln)
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	hs, _ := protocol.Encode(protocol.Handshake, protocol.HandshakePayload{Version: protocol.Version})
+	if err := protocol.WriteFrame(conn, hs); err != nil {
+		t.Fatalf("WriteFrame(handshake): %v", err)
+	}
+	if f, err := protocol.ReadFrame(conn); err != nil || f.Type != protocol.Ack {
+		t.Fatalf("handshake ack: f=%+v err=%v", f, err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "t.test")
+	payload := []byte("#!/bin/sh\necho hello from pushed binary\n")
+	push, _ := protocol.Encode(protocol.PushBinary, protocol.PushBinaryPayload{Path: dst, Size: int64(len(payload))})
+	if err := protocol.WriteFrame(conn, push); err != nil {
+		t.Fatalf("WriteFrame(push-binary): %v", err)
+	}
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("write payload: %v", err)
+	}
+	f, err := protocol.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("ReadFrame(push ack): %v", err)
+	}
+	if f.Type != protocol.Ack {
+		t.Fatalf("push-binary: got %s, want ack", f.Type)
+	}
+	if err := os.Chmod(dst, 0755); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	// This is the frame that used to fail with a broken pipe: handleConn
+	// had already closed the connection after acking the push.
+	run, _ := protocol.Encode(protocol.Run, protocol.RunPayload{Argv: []string{"/bin/sh", dst}})
+	if err := protocol.WriteFrame(conn, run); err != nil {
+		t.Fatalf("WriteFrame(run): %v", err)
+	}
+
+	var stdout []byte
+	for {
+		f, err := protocol.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("ReadFrame(run response): %v", err)
+		}
+		switch f.Type {
+		case protocol.Output:
+			var out protocol.OutputPayload
+			if err := protocol.Decode(f, &out); err != nil {
+				t.Fatalf("Decode(output): %v", err)
+			}
+			if out.Stream == "stdout" {
+				stdout = append(stdout, out.Data...)
+			}
+		case protocol.Exit:
+			var e protocol.ExitPayload
+			if err := protocol.Decode(f, &e); err != nil {
+				t.Fatalf("Decode(exit): %v", err)
+			}
+			if e.Code != 0 {
+				t.Fatalf("exit code = %d, want 0", e.Code)
+			}
+			if got, want := string(stdout), "hello from pushed binary\n"; got != want {
+				t.Fatalf("stdout = %q, want %q", got, want)
+			}
+			return
+		case protocol.Error:
+			var e protocol.ErrorPayload
+			protocol.Decode(f, &e)
+			t.Fatalf("goexecd: %s", e.Message)
+		default:
+			t.Fatalf("unexpected frame: %s", f.Type)
+		}
+	}
+}
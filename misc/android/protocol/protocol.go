@@ -0,0 +1,150 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package protocol implements the framing used between go_android_exec and
+// the optional persistent goexecd helper it runs on-device, so that running
+// a test binary doesn't require a fresh "adb exec-out" round trip.
+//
+// A frame is a 4-byte big-endian length prefix followed by that many bytes
+// of JSON: {"type": "...", "payload": ...}. A pushed test binary is not part
+// of any frame: PushBinary announces its size and the raw bytes follow
+// immediately on the same connection, so the binary itself never passes
+// through JSON. A running binary's stdout/stderr, on the other hand, is
+// small and frequent enough that each chunk is just base64 inside an Output
+// frame's payload.
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Version identifies the wire format. A client and helper must agree on it
+// before exchanging any other frame.
+const Version = 1
+
+// maxFrameSize bounds how much a corrupt or malicious length prefix can make
+// ReadFrame allocate.
+const maxFrameSize = 64 << 20 // 64MiB
+
+// Type identifies the kind of message carried by a Frame.
+type Type string
+
+const (
+	Handshake  Type = "handshake"   // client -> helper: propose Version
+	PushBinary Type = "push-binary" // client -> helper: write the Size raw bytes that follow to Path (created with mode 0755)
+	Run        Type = "run"         // client -> helper: execute Argv
+	Kill       Type = "kill"        // client -> helper: signal a running binary by name
+	Output     Type = "output"      // helper -> client: a chunk of stdout or stderr
+	Exit       Type = "exit"        // helper -> client: the run's exit code
+	Ack        Type = "ack"         // helper -> client: request accepted
+	Error      Type = "error"       // helper -> client: request failed
+)
+
+// Frame is the envelope written and read by WriteFrame and ReadFrame.
+type Frame struct {
+	Type    Type            `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// HandshakePayload is the Handshake payload.
+type HandshakePayload struct {
+	Version int `json:"version"`
+}
+
+// PushBinaryPayload is the PushBinary payload. It announces an inline
+// transfer; Size bytes of raw file content immediately follow the frame on
+// the same stream.
+type PushBinaryPayload struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// RunPayload is the Run payload.
+type RunPayload struct {
+	Cwd  string   `json:"cwd"`
+	Env  []string `json:"env"`
+	Argv []string `json:"argv"`
+}
+
+// KillPayload is the Kill payload.
+type KillPayload struct {
+	Name string `json:"name"`
+}
+
+// OutputPayload is the Output payload. Stream is "stdout" or "stderr".
+type OutputPayload struct {
+	Stream string `json:"stream"`
+	Data   []byte `json:"data"`
+}
+
+// ExitPayload is the Exit payload.
+type ExitPayload struct {
+	Code int `json:"code"`
+}
+
+// ErrorPayload is the Error payload.
+type ErrorPayload struct {
+	Message string `json:"message"`
+}
+
+// Encode builds a Frame of the given type carrying payload, which may be nil
+// for frame types that carry no data (currently only Ack).
+func Encode(typ Type, payload any) (Frame, error) {
+	if payload == nil {
+		return Frame{Type: typ}, nil
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Frame{}, fmt.Errorf("protocol: encode %s: %w", typ, err)
+	}
+	return Frame{Type: typ, Payload: raw}, nil
+}
+
+// Decode unmarshals f's payload into v, which should be a pointer to the
+// payload type matching f.Type.
+func Decode(f Frame, v any) error {
+	if err := json.Unmarshal(f.Payload, v); err != nil {
+		return fmt.Errorf("protocol: decode %s: %w", f.Type, err)
+	}
+	return nil
+}
+
+// WriteFrame writes f to w as a length-prefixed JSON message.
+func WriteFrame(w io.Writer, f Frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("protocol: marshal frame: %w", err)
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadFrame reads a single length-prefixed frame written by WriteFrame.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return Frame{}, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxFrameSize {
+		return Frame{}, fmt.Errorf("protocol: frame of %d bytes exceeds %d byte limit", n, maxFrameSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Frame{}, err
+	}
+	var f Frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return Frame{}, fmt.Errorf("protocol: unmarshal frame: %w", err)
+	}
+	return f, nil
+}
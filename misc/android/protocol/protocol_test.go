@@ -0,0 +1,78 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	cases := []struct {
+		name    string
+		typ     Type
+		payload any
+	}{
+		{"handshake", Handshake, HandshakePayload{Version: Version}},
+		{"push-binary", PushBinary, PushBinaryPayload{Path: "/data/local/tmp/go_android_exec/t.test", Size: 1234}},
+		{"run", Run, RunPayload{Cwd: "/data/local/tmp/go_android_exec/src/pkg", Env: []string{"GOROOT=/x", "TMPDIR=/y"}, Argv: []string{"./t.test", "-test.v"}}},
+		{"kill", Kill, KillPayload{Name: "t.test"}},
+		{"output", Output, OutputPayload{Stream: "stderr", Data: []byte("panic: boom\n")}},
+		{"exit", Exit, ExitPayload{Code: 2}},
+		{"ack", Ack, nil},
+		{"error", Error, ErrorPayload{Message: "no such file"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := Encode(c.typ, c.payload)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if f.Type != c.typ {
+				t.Fatalf("Encode: Type = %q, want %q", f.Type, c.typ)
+			}
+
+			var buf bytes.Buffer
+			if err := WriteFrame(&buf, f); err != nil {
+				t.Fatalf("WriteFrame: %v", err)
+			}
+
+			got, err := ReadFrame(&buf)
+			if err != nil {
+				t.Fatalf("ReadFrame: %v", err)
+			}
+			if got.Type != c.typ {
+				t.Fatalf("ReadFrame: Type = %q, want %q", got.Type, c.typ)
+			}
+
+			if c.payload == nil {
+				return
+			}
+			decoded := reflect.New(reflect.TypeOf(c.payload)).Interface()
+			if err := Decode(got, decoded); err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if got := reflect.ValueOf(decoded).Elem().Interface(); !reflect.DeepEqual(got, c.payload) {
+				t.Errorf("Decode = %#v, want %#v", got, c.payload)
+			}
+		})
+	}
+}
+
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff}) // 4294967295 bytes, far past maxFrameSize
+	if _, err := ReadFrame(&buf); err == nil {
+		t.Fatal("ReadFrame accepted a frame length past maxFrameSize")
+	}
+}
+
+func TestReadFrameShortInput(t *testing.T) {
+	if _, err := ReadFrame(bytes.NewReader([]byte{0, 0})); err == nil {
+		t.Fatal("ReadFrame accepted a truncated length prefix")
+	}
+}